@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
+	"github.com/u3mur4/megadl"
+	"golang.org/x/crypto/ssh"
+)
+
+// Downloader resolves a url to a readable stream and its size, so download()
+// never has to know how any particular backend is actually fetched from.
+type Downloader interface {
+	Download(url string) (io.ReadCloser, int64, error)
+}
+
+// DownloaderFactory builds a Downloader for a url that has already been
+// matched to the scheme the factory was Register-ed under.
+type DownloaderFactory func(url string) Downloader
+
+var downloaderFactories = map[string]DownloaderFactory{}
+
+// Register installs a Downloader factory for scheme, letting third parties
+// compile in additional backends beyond the ones shipped here.
+func Register(scheme string, factory DownloaderFactory) {
+	downloaderFactories[scheme] = factory
+}
+
+// sftpPrivateKeyFile is populated from Config.SftpPrivateKey before any
+// downloads start; the sftp:// Downloader has no other way to receive it
+// since factories are only ever called with a url.
+var sftpPrivateKeyFile string
+
+func init() {
+	Register("http", func(string) Downloader { return httpDownloader{} })
+	Register("https", func(string) Downloader { return httpDownloader{} })
+	Register("mega", func(string) Downloader { return megaDownloader{} })
+	Register("ftp", func(string) Downloader { return ftpDownloader{} })
+	Register("sftp", func(string) Downloader { return sftpDownloader{privateKeyFile: sftpPrivateKeyFile} })
+	Register("file", func(string) Downloader { return fileDownloader{} })
+}
+
+// downloaderScheme extracts the scheme resolveDownloader dispatches on,
+// treating legacy https://mega.nz/... URLs the same as an explicit mega://
+// scheme so existing updater.yaml files keep working.
+func downloaderScheme(rawUrl string) string {
+	if strings.HasPrefix(rawUrl, "mega://") || strings.HasPrefix(rawUrl, "https://mega.nz/") {
+		return "mega"
+	}
+
+	if i := strings.Index(rawUrl, "://"); i != -1 {
+		return rawUrl[:i]
+	}
+
+	return "file"
+}
+
+func resolveDownloader(url string) (Downloader, error) {
+	scheme := downloaderScheme(url)
+
+	factory, ok := downloaderFactories[scheme]
+	if !ok {
+		return nil, fmt.Errorf("no downloader registered for scheme %q", scheme)
+	}
+
+	return factory(url), nil
+}
+
+// ResumableDownloader is implemented by backends that can continue a
+// previously interrupted transfer by requesting only the bytes after
+// offset. resumed reports whether the server actually honoured the range;
+// when it is false the caller must discard reader, if non-nil, and fall
+// back to a plain Download from the start. total is the full size of the
+// remote file as reported alongside the range, so the caller can detect a
+// file that changed since the partial download started and restart from
+// scratch instead of appending a mismatched tail.
+type ResumableDownloader interface {
+	DownloadRange(url string, offset int64) (reader io.ReadCloser, remaining int64, total int64, resumed bool, err error)
+}
+
+type httpDownloader struct{}
+
+func (httpDownloader) Download(url string) (io.ReadCloser, int64, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response.Body, response.ContentLength, nil
+}
+
+func (httpDownloader) DownloadRange(url string, offset int64) (io.ReadCloser, int64, int64, bool, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, 0, 0, false, err
+	}
+
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return nil, 0, 0, false, nil
+	}
+
+	total, ok := parseContentRangeTotal(response.Header.Get("Content-Range"), offset)
+	if !ok {
+		response.Body.Close()
+		return nil, 0, 0, false, nil
+	}
+
+	return response.Body, response.ContentLength, total, true, nil
+}
+
+// parseContentRangeTotal checks that header is a "bytes start-end/total"
+// Content-Range starting at offset and returns its total size. It rejects
+// an unknown total ("bytes start-end/*") along with any other mismatch,
+// since the caller has nothing to compare a later resume attempt against
+// otherwise.
+func parseContentRangeTotal(header string, offset int64) (int64, bool) {
+	prefix := fmt.Sprintf("bytes %d-", offset)
+	if !strings.HasPrefix(header, prefix) {
+		return 0, false
+	}
+
+	i := strings.LastIndexByte(header, '/')
+	if i == -1 {
+		return 0, false
+	}
+
+	total, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return total, true
+}
+
+// megaDownloader carries the mega.nz URL munging that used to live inline
+// in download(): mega share links use '#' where the API needs '!', and
+// the modern /file/ path form needs rewriting to the legacy '#!' form.
+type megaDownloader struct{}
+
+func (megaDownloader) Download(rawUrl string) (io.ReadCloser, int64, error) {
+	rawUrl = strings.TrimPrefix(rawUrl, "mega://")
+	rawUrl = strings.Replace(rawUrl, "#", "!", 1)
+	rawUrl = strings.Replace(rawUrl, "/file/", "/#!", 1)
+
+	reader, info, err := megadl.Download(rawUrl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return reader, int64(info.Size), nil
+}
+
+// fileDownloader reads a patch straight off disk, for mirrors on a LAN
+// share at a LAN party.
+type fileDownloader struct{}
+
+func (fileDownloader) Download(rawUrl string) (io.ReadCloser, int64, error) {
+	path := strings.TrimPrefix(rawUrl, "file://")
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+type ftpDownloader struct{}
+
+func (ftpDownloader) Download(rawUrl string) (io.ReadCloser, int64, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addr := parsed.Host
+	if parsed.Port() == "" {
+		addr = net.JoinHostPort(parsed.Hostname(), "21")
+	}
+
+	client, err := ftp.Dial(addr, ftp.DialWithTimeout(30*time.Second))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	username, password := "anonymous", "anonymous"
+	if parsed.User != nil {
+		username = parsed.User.Username()
+		if p, ok := parsed.User.Password(); ok {
+			password = p
+		}
+	}
+
+	if err := client.Login(username, password); err != nil {
+		client.Quit()
+		return nil, 0, err
+	}
+
+	size, err := client.FileSize(parsed.Path)
+	if err != nil {
+		client.Quit()
+		return nil, 0, err
+	}
+
+	response, err := client.Retr(parsed.Path)
+	if err != nil {
+		client.Quit()
+		return nil, 0, err
+	}
+
+	return ftpReadCloser{response, client}, size, nil
+}
+
+// ftpReadCloser closes both the retrieved file stream and the underlying
+// control connection once the caller is done reading.
+type ftpReadCloser struct {
+	*ftp.Response
+	client *ftp.ServerConn
+}
+
+func (r ftpReadCloser) Close() error {
+	err := r.Response.Close()
+	_ = r.client.Quit()
+
+	return err
+}
+
+// sftpDownloader authenticates either with a private key file (set via
+// Config.SftpPrivateKey in updater.yaml) or with a password from the URL's
+// userinfo.
+type sftpDownloader struct {
+	privateKeyFile string
+}
+
+func (d sftpDownloader) Download(rawUrl string) (io.ReadCloser, int64, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addr := parsed.Host
+	if parsed.Port() == "" {
+		addr = net.JoinHostPort(parsed.Hostname(), "22")
+	}
+
+	username := "anonymous"
+	if parsed.User != nil {
+		username = parsed.User.Username()
+	}
+
+	var auth []ssh.AuthMethod
+
+	if d.privateKeyFile != "" {
+		key, err := os.ReadFile(d.privateKeyFile)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else if parsed.User != nil {
+		if password, ok := parsed.User.Password(); ok {
+			auth = append(auth, ssh.Password(password))
+		}
+	}
+
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, 0, err
+	}
+
+	file, err := sftpClient.Open(parsed.Path)
+	if err != nil {
+		sftpClient.Close()
+		sshClient.Close()
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		sftpClient.Close()
+		sshClient.Close()
+		return nil, 0, err
+	}
+
+	return sftpReadCloser{file, sftpClient, sshClient}, info.Size(), nil
+}
+
+// sftpReadCloser tears down the sftp client and its ssh transport once the
+// caller closes the file, mirroring ftpReadCloser.
+type sftpReadCloser struct {
+	*sftp.File
+	client    *sftp.Client
+	sshClient *ssh.Client
+}
+
+func (r sftpReadCloser) Close() error {
+	err := r.File.Close()
+	_ = r.client.Close()
+	_ = r.sshClient.Close()
+
+	return err
+}
@@ -3,101 +3,503 @@ package main
 import (
 	"archive/zip"
 	"bufio"
-	"errors"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/bodgit/sevenzip"
-	"github.com/u3mur4/megadl"
 	"gopkg.in/yaml.v3"
 	"io"
-	"net/http"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-type progressWriter struct {
-	totalSize   int64
-	downloaded  int64
-	lastPercent int
+// defaultConcurrentDownloads is used when the config does not set
+// concurrent_downloads.
+const defaultConcurrentDownloads = 5
+
+// GenericUpdate is a point-in-time progress snapshot for a named transfer
+// or extraction, independent of how it ends up being rendered.
+type GenericUpdate struct {
+	Name       string
+	Progress   float64
+	BytesDone  int64
+	BytesTotal int64
+	Speed      float64
+	ETA        time.Duration
 }
 
-func (pw *progressWriter) Write(p []byte) (int, error) {
-	n := len(p)
-	pw.downloaded += int64(n)
-	percent := int((pw.downloaded * 100) / pw.totalSize)
+// progressEmitInterval throttles how often a Progresser turns bytes
+// written into a GenericUpdate, so fast local copies don't flood the sink.
+const progressEmitInterval = 100 * time.Millisecond
+
+// Progresser is an io.Writer meant to be used as the side-channel of an
+// io.TeeReader: every chunk read from a download or written during
+// extraction is turned into a GenericUpdate carrying byte counts, speed
+// and ETA, and sent to Updates.
+type Progresser struct {
+	Name    string
+	Total   int64
+	Updates chan<- GenericUpdate
+
+	done     int64
+	start    time.Time
+	lastSend time.Time
+}
+
+func NewProgresser(name string, total int64, updates chan<- GenericUpdate) *Progresser {
+	return &Progresser{Name: name, Total: total, Updates: updates, start: time.Now()}
+}
 
-	if percent > pw.lastPercent {
-		pw.lastPercent = percent
-		fmt.Printf("\rProgress: %d%%", percent)
+func (p *Progresser) Write(b []byte) (int, error) {
+	n := len(b)
+	p.done += int64(n)
+
+	if now := time.Now(); now.Sub(p.lastSend) >= progressEmitInterval {
+		p.lastSend = now
+		p.send()
 	}
 
 	return n, nil
 }
 
-func download(url string, file string, progress bool) error {
-	var reader io.ReadCloser
-	var size int64
-	var err error
+// Finish sends a final update, so transfers too short to ever cross
+// progressEmitInterval still report completion.
+func (p *Progresser) Finish() {
+	p.send()
+}
+
+func (p *Progresser) send() {
+	if p.Updates != nil {
+		p.Updates <- p.snapshot()
+	}
+}
 
-	if strings.HasPrefix(url, "https://mega.nz/") {
-		url = strings.Replace(url, "#", "!", 1)
-		url = strings.Replace(url, "/file/", "/#!", 1)
+func (p *Progresser) snapshot() GenericUpdate {
+	elapsed := time.Since(p.start).Seconds()
 
-		var info *megadl.Info
+	var speed float64
+	if elapsed > 0 {
+		speed = float64(p.done) / elapsed
+	}
 
-		reader, info, err = megadl.Download(url)
+	var progress float64
+	var eta time.Duration
 
-		if err != nil {
+	if p.Total > 0 {
+		progress = float64(p.done) / float64(p.Total)
+
+		if speed > 0 {
+			eta = time.Duration(float64(p.Total-p.done) / speed * float64(time.Second))
+		}
+	}
+
+	return GenericUpdate{
+		Name:       p.Name,
+		Progress:   progress,
+		BytesDone:  p.done,
+		BytesTotal: p.Total,
+		Speed:      speed,
+		ETA:        eta,
+	}
+}
+
+// ProgressSink receives progress events for named transfers. Start/Done
+// bracket a transfer so a renderer knows which ones are still active.
+type ProgressSink interface {
+	Start(name string)
+	Update(update GenericUpdate)
+	Done(name string)
+}
+
+// noopSink discards progress events, used for downloads too small to be
+// worth reporting (e.g. the version file) and for --progress=none.
+type noopSink struct{}
+
+func (noopSink) Start(string)          {}
+func (noopSink) Update(GenericUpdate) {}
+func (noopSink) Done(string)          {}
+
+// jsonSink writes one JSON object per progress event to w, for CI runs
+// where a human-readable terminal display isn't useful.
+type jsonSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONSink(w io.Writer) *jsonSink {
+	return &jsonSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) Start(string) {}
+
+func (s *jsonSink) Update(update GenericUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_ = s.encoder.Encode(update)
+}
+
+func (s *jsonSink) Done(string) {}
+
+// terminalSink renders every active transfer as its own line, using ANSI
+// cursor moves to redraw the whole block in place on each update so
+// parallel downloads don't scroll the terminal.
+type terminalSink struct {
+	mu     sync.Mutex
+	order  []string
+	active map[string]GenericUpdate
+	lines  int
+}
+
+func newTerminalSink() *terminalSink {
+	return &terminalSink{active: make(map[string]GenericUpdate)}
+}
+
+func (s *terminalSink) Start(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[name]; !ok {
+		s.order = append(s.order, name)
+		s.active[name] = GenericUpdate{Name: name}
+	}
+
+	s.render()
+}
+
+func (s *terminalSink) Update(update GenericUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.active[update.Name]; !ok {
+		s.order = append(s.order, update.Name)
+	}
+	s.active[update.Name] = update
+
+	s.render()
+}
+
+func (s *terminalSink) Done(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.active, name)
+
+	remaining := s.order[:0]
+	for _, n := range s.order {
+		if n != name {
+			remaining = append(remaining, n)
+		}
+	}
+	s.order = remaining
+
+	s.render()
+}
+
+func (s *terminalSink) render() {
+	if s.lines > 0 {
+		fmt.Printf("\033[%dA", s.lines)
+	}
+
+	for _, name := range s.order {
+		update := s.active[name]
+		fmt.Printf("\033[2K%s: %s/%s  %s/s  eta %s\n",
+			name,
+			formatBytes(update.BytesDone), formatBytes(update.BytesTotal),
+			formatBytes(int64(update.Speed)), formatETA(update.ETA))
+	}
+
+	// Clear whatever the previous render left below the cursor, so a
+	// shrinking transfer count (one of several downloads finishing)
+	// doesn't leave its old lines behind as stale garbage.
+	fmt.Print("\033[J")
+
+	s.lines = len(s.order)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for val := n / unit; val >= unit; val /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatETA(eta time.Duration) string {
+	if eta <= 0 {
+		return "-"
+	}
+
+	return eta.Round(time.Second).String()
+}
+
+// newProgressSink builds the ProgressSink selected by --progress.
+func newProgressSink(mode string) (ProgressSink, error) {
+	switch mode {
+	case "", "terminal":
+		return newTerminalSink(), nil
+	case "json":
+		return newJSONSink(os.Stdout), nil
+	case "none":
+		return noopSink{}, nil
+	default:
+		return nil, fmt.Errorf("unknown --progress mode %q", mode)
+	}
+}
+
+// multiHandler fans a log record out to several slog.Handlers, used to
+// keep a human-friendly text log on stdout while also writing structured
+// JSON to a file when --log-json is set.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range m {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, handler := range m {
+		if !handler.Enabled(ctx, record.Level) {
+			continue
+		}
+
+		if err := handler.Handle(ctx, record.Clone()); err != nil {
 			return err
 		}
+	}
 
-		size = int64(info.Size)
-	} else {
-		var response *http.Response
-		response, err = http.Get(url)
+	return nil
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, handler := range m {
+		next[i] = handler.WithAttrs(attrs)
+	}
+
+	return next
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	next := make(multiHandler, len(m))
+	for i, handler := range m {
+		next[i] = handler.WithGroup(name)
+	}
+
+	return next
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch level {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown --log-level %q", level)
+	}
+}
+
+// newLogger builds the *slog.Logger used throughout the updater. Human
+// readable text always goes to stdout; when logJSONFile is set, the same
+// records are additionally written there as JSON lines for tooling to
+// grep or parse. The returned close func must be called before the
+// process exits.
+func newLogger(level string, logJSONFile string) (*slog.Logger, func(), error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	handler := slog.Handler(slog.NewTextHandler(os.Stdout, opts))
+	closeLogger := func() {}
 
+	if logJSONFile != "" {
+		file, err := os.OpenFile(logJSONFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("open --log-json file %s: %w", logJSONFile, err)
 		}
 
-		reader = response.Body
-		size = response.ContentLength
+		handler = multiHandler{handler, slog.NewJSONHandler(file, opts)}
+		closeLogger = func() { _ = file.Close() }
 	}
 
-	defer reader.Close()
+	return slog.New(handler), closeLogger, nil
+}
+
+func download(url string, file string, name string, sink ProgressSink, logger *slog.Logger) error {
+	logger = logger.With("mod", name, "url", url)
+	logger.Debug("starting download")
+	start := time.Now()
 
-	out, err := os.Create(file)
+	downloader, err := resolveDownloader(url)
 	if err != nil {
-		return err
+		return fmt.Errorf("download %s: %w", name, err)
 	}
-	defer out.Close()
 
-	var in io.Reader
+	partFile := file + ".part"
+	sizeFile := partFile + ".size"
 
-	if progress {
-		progressWriter := &progressWriter{
-			totalSize:   size,
-			downloaded:  0,
-			lastPercent: -1,
+	var offset int64
+	if info, statErr := os.Stat(partFile); statErr == nil {
+		offset = info.Size()
+	}
+
+	var reader io.ReadCloser
+	var size int64
+
+	if offset > 0 {
+		resumable, resumableOk := downloader.(ResumableDownloader)
+		knownSize, knownSizeOk := readPersistedSize(sizeFile)
+
+		if !resumableOk || !knownSizeOk {
+			offset = 0
+		} else {
+			var remaining, total int64
+			var resumed bool
+
+			reader, remaining, total, resumed, err = resumable.DownloadRange(url, offset)
+			if err != nil {
+				return fmt.Errorf("resume download %s: %w", name, err)
+			}
+
+			if resumed && total == knownSize {
+				size = offset + remaining
+				logger.Debug("resuming download", "offset", offset)
+			} else {
+				if reader != nil {
+					reader.Close()
+					reader = nil
+				}
+
+				if resumed {
+					logger.Debug("remote file size changed since the partial download started, restarting", "mod", name, "was", knownSize, "now", total)
+				}
+
+				offset = 0
+			}
+		}
+	}
+
+	if reader == nil {
+		reader, size, err = downloader.Download(url)
+		if err != nil {
+			return fmt.Errorf("download %s: %w", name, err)
 		}
-		in = io.TeeReader(reader, progressWriter)
+
+		if err := writePersistedSize(sizeFile, size); err != nil {
+			reader.Close()
+			return fmt.Errorf("record expected size for %s: %w", name, err)
+		}
+	}
+	defer reader.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset > 0 {
+		flags |= os.O_APPEND
 	} else {
-		in = reader
+		flags |= os.O_TRUNC
 	}
 
-	_, err = io.Copy(out, in)
+	out, err := os.OpenFile(partFile, flags, 0644)
 	if err != nil {
-		return err
+		return fmt.Errorf("create %s: %w", partFile, err)
+	}
+	defer out.Close()
+
+	updates := make(chan GenericUpdate)
+	pumped := make(chan struct{})
+
+	go func() {
+		for update := range updates {
+			sink.Update(update)
+		}
+		close(pumped)
+	}()
+
+	sink.Start(name)
+	progresser := NewProgresser(name, size, updates)
+	progresser.done = offset
+
+	bytesDone, err := io.Copy(out, io.TeeReader(reader, progresser))
+
+	progresser.Finish()
+	close(updates)
+	<-pumped
+	sink.Done(name)
+
+	if err != nil {
+		return fmt.Errorf("download %s to %s: %w", name, file, err)
 	}
 
-	if progress {
-		fmt.Println()
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", partFile, err)
 	}
 
+	if err := os.Rename(partFile, file); err != nil {
+		return fmt.Errorf("rename %s to %s: %w", partFile, file, err)
+	}
+
+	_ = os.Remove(sizeFile)
+
+	logger.Info("downloaded", "bytes", offset+bytesDone, "duration", time.Since(start))
+
 	return nil
 }
 
+// readPersistedSize reads the expected total size recorded alongside a
+// .part file by writePersistedSize. ok is false if nothing was recorded or
+// it can't be parsed, meaning a resume attempt has nothing to validate the
+// remote file against and should restart from scratch instead.
+func readPersistedSize(sizeFile string) (size int64, ok bool) {
+	data, err := os.ReadFile(sizeFile)
+	if err != nil {
+		return 0, false
+	}
+
+	size, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// writePersistedSize records the expected total size of a download next
+// to its .part file, so a later resume can detect that the remote file
+// changed since the partial download started and restart instead of
+// appending a mismatched tail.
+func writePersistedSize(sizeFile string, size int64) error {
+	return os.WriteFile(sizeFile, []byte(strconv.FormatInt(size, 10)), 0644)
+}
+
 func readVersion(file string) (string, error) {
 	data, err := os.ReadFile(file)
 	if err != nil {
@@ -112,70 +514,324 @@ func fileExists(file string) bool {
 	return !os.IsNotExist(err) && !info.IsDir()
 }
 
-func extractZipArchive() error {
+// stagingDir holds freshly extracted files before they are moved into
+// place, so a patch application that fails partway through never leaves a
+// half-written install behind.
+const stagingDir = "_staging"
+
+// backupDir holds a timestamped copy of every file a patch application
+// has overwritten, so a failed move can be undone and --rollback can
+// restore the previous install later.
+const backupDir = "_backup"
+
+// createdManifestSuffix names the sibling file next to a backup directory
+// that lists files the patch introduced rather than overwrote. They have
+// nothing to restore from, so --rollback removes them instead.
+const createdManifestSuffix = ".created"
+
+// stagingArea collects the files a single extraction changes before
+// commit moves them into place atomically.
+type stagingArea struct {
+	dir   string
+	files []string
+}
+
+func newStagingArea() (*stagingArea, error) {
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return nil, fmt.Errorf("clear staging dir %s: %w", stagingDir, err)
+	}
+
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create staging dir %s: %w", stagingDir, err)
+	}
+
+	return &stagingArea{dir: stagingDir}, nil
+}
+
+// path returns where a changed archive entry should be extracted to,
+// creating its parent directory and recording it for commit.
+func (s *stagingArea) path(name string) (string, error) {
+	staged := filepath.Join(s.dir, name)
+
+	if err := os.MkdirAll(filepath.Dir(staged), os.ModePerm); err != nil {
+		return "", fmt.Errorf("create directory for %s: %w", name, err)
+	}
+
+	s.files = append(s.files, name)
+
+	return staged, nil
+}
+
+// commit moves every staged file into place, backing up whatever it
+// replaces under a timestamped backupDir subdirectory first and recording
+// any file it newly introduces in that backup's .created manifest, so
+// --rollback can undo both. If moving any file fails, every file already
+// moved is restored from that backup before commit returns, so a failed
+// patch leaves the install exactly as it found it.
+func (s *stagingArea) commit(logger *slog.Logger) error {
+	defer os.RemoveAll(s.dir)
+
+	if len(s.files) == 0 {
+		return nil
+	}
+
+	backup := filepath.Join(backupDir, time.Now().Format("20060102-150405"))
+	var created []string
+
+	// touched records, in order, every file commit has started moving,
+	// so a failure partway through can be unwound precisely: a file
+	// that was only backed up just needs its backup moved back, while
+	// one that was also already replaced needs the replacement removed
+	// first.
+	type touchedFile struct {
+		name     string
+		backedUp bool
+		replaced bool
+	}
+
+	var touched []touchedFile
+
+	restore := func() {
+		for i := len(touched) - 1; i >= 0; i-- {
+			file := touched[i]
+
+			if file.replaced {
+				_ = os.Remove(file.name)
+			}
+
+			if file.backedUp {
+				_ = os.MkdirAll(filepath.Dir(file.name), os.ModePerm)
+				_ = os.Rename(filepath.Join(backup, file.name), file.name)
+			}
+		}
+
+		// The backup is only a valid rollback target once commit fully
+		// succeeds; on failure remove it so --rollback can't later pick
+		// this partial, already-restored attempt over a prior good one.
+		_ = os.RemoveAll(backup)
+	}
+
+	for _, name := range s.files {
+		file := touchedFile{name: name}
+
+		if fileExists(name) {
+			backedUp := filepath.Join(backup, name)
+
+			if err := os.MkdirAll(filepath.Dir(backedUp), os.ModePerm); err != nil {
+				restore()
+				return fmt.Errorf("back up %s: %w", name, err)
+			}
+
+			if err := os.Rename(name, backedUp); err != nil {
+				restore()
+				return fmt.Errorf("back up %s: %w", name, err)
+			}
+
+			file.backedUp = true
+		} else {
+			created = append(created, name)
+		}
+
+		// Record progress as soon as the backup rename succeeds, before
+		// attempting the replace, so a failure on the next line finds
+		// this file in touched and restores its backup instead of
+		// skipping it.
+		touched = append(touched, file)
+
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			restore()
+			return fmt.Errorf("create directory for %s: %w", name, err)
+		}
+
+		if err := os.Rename(filepath.Join(s.dir, name), name); err != nil {
+			restore()
+			return fmt.Errorf("apply %s: %w", name, err)
+		}
+
+		touched[len(touched)-1].replaced = true
+	}
+
+	if len(created) > 0 {
+		manifest := backup + createdManifestSuffix
+
+		if err := os.MkdirAll(filepath.Dir(manifest), os.ModePerm); err != nil {
+			restore()
+			return fmt.Errorf("record created files: %w", err)
+		}
+
+		if err := os.WriteFile(manifest, []byte(strings.Join(created, "\n")), 0o644); err != nil {
+			restore()
+			return fmt.Errorf("record created files: %w", err)
+		}
+	}
+
+	logger.Debug("patch applied", "files", len(s.files), "backup", backup)
+
+	return nil
+}
+
+// archiveFileIsTheSame reports whether the file already on disk at
+// fileName has the same sha1 digest as an archive entry, so extraction can
+// skip staging files a patch doesn't actually change.
+func archiveFileIsTheSame(fileName string, open func() (io.ReadCloser, error)) (bool, error) {
+	if !fileExists(fileName) {
+		return false, nil
+	}
+
+	entry, err := open()
+	if err != nil {
+		return false, err
+	}
+
+	entrySum, err := sha1Reader(entry)
+	if err != nil {
+		return false, err
+	}
+
+	existing, err := os.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+
+	existingSum, err := sha1Reader(existing)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(entrySum, existingSum), nil
+}
+
+func sha1Reader(reader io.ReadCloser) ([]byte, error) {
+	defer reader.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+func extractZipArchive(file string, name string, sink ProgressSink, logger *slog.Logger) error {
 	var err error
-	reader, err := zip.OpenReader("_patch.zip")
+	reader, err := zip.OpenReader(file)
 	if err != nil {
-		return err
+		return fmt.Errorf("open %s: %w", file, err)
 	}
 	defer reader.Close()
 
+	var total int64
+	for _, zipFile := range reader.File {
+		if !zipFile.FileInfo().IsDir() {
+			total += int64(zipFile.UncompressedSize64)
+		}
+	}
+
+	sink.Start(name)
+	progresser := NewProgresser(name, total, nil)
+
+	staging, err := newStagingArea()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging.dir)
+
 	for _, file := range reader.File {
 		if file.FileInfo().IsDir() {
 			continue
 		}
 
-		err = os.MkdirAll(filepath.Dir(file.Name), os.ModePerm)
+		same, err := archiveFileIsTheSame(file.Name, file.Open)
 		if err != nil {
-			return err
+			return fmt.Errorf("compare %s: %w", file.Name, err)
 		}
 
-		err = extractZipFile(file)
-		if err != nil {
-			return err
+		if !same {
+			staged, err := staging.path(file.Name)
+			if err != nil {
+				return err
+			}
+
+			err = extractZipFile(file, staged)
+			if err != nil {
+				return fmt.Errorf("extract %s: %w", file.Name, err)
+			}
 		}
+
+		progresser.done += int64(file.UncompressedSize64)
+		sink.Update(progresser.snapshot())
 	}
 
-	return nil
+	sink.Done(name)
+
+	return staging.commit(logger)
 }
 
-func extractSevenZipArchive(password *string) error {
+func extractSevenZipArchive(file string, password *string, name string, sink ProgressSink, logger *slog.Logger) error {
 	var err error
 	var reader *sevenzip.ReadCloser
 
 	if password == nil {
-		reader, err = sevenzip.OpenReader("_patch.7z")
+		reader, err = sevenzip.OpenReader(file)
 	} else {
-		reader, err = sevenzip.OpenReaderWithPassword("_patch.7z", *password)
+		reader, err = sevenzip.OpenReaderWithPassword(file, *password)
 	}
 
 	if err != nil {
-		return err
+		return fmt.Errorf("open %s: %w", file, err)
 	}
 
 	defer reader.Close()
 
+	var total int64
+	for _, zipFile := range reader.File {
+		if !zipFile.FileInfo().IsDir() {
+			total += int64(zipFile.UncompressedSize)
+		}
+	}
+
+	sink.Start(name)
+	progresser := NewProgresser(name, total, nil)
+
+	staging, err := newStagingArea()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging.dir)
+
 	for _, file := range reader.File {
 		if file.FileInfo().IsDir() {
 			continue
 		}
 
-		err = os.MkdirAll(filepath.Dir(file.Name), os.ModePerm)
+		same, err := archiveFileIsTheSame(file.Name, file.Open)
 		if err != nil {
-			return err
+			return fmt.Errorf("compare %s: %w", file.Name, err)
 		}
 
-		err = extractSevenZipFile(file)
-		if err != nil {
-			return err
+		if !same {
+			staged, err := staging.path(file.Name)
+			if err != nil {
+				return err
+			}
+
+			err = extractSevenZipFile(file, staged)
+			if err != nil {
+				return fmt.Errorf("extract %s: %w", file.Name, err)
+			}
 		}
+
+		progresser.done += int64(file.UncompressedSize)
+		sink.Update(progresser.snapshot())
 	}
 
-	return nil
+	sink.Done(name)
+
+	return staging.commit(logger)
 }
 
-func extractZipFile(zipFile *zip.File) error {
-	out, err := os.Create(zipFile.Name)
+func extractZipFile(zipFile *zip.File, dest string) error {
+	out, err := os.Create(dest)
 	if err != nil {
 		return err
 	}
@@ -192,8 +848,8 @@ func extractZipFile(zipFile *zip.File) error {
 	return err
 }
 
-func extractSevenZipFile(zipFile *sevenzip.File) error {
-	out, err := os.Create(zipFile.Name)
+func extractSevenZipFile(zipFile *sevenzip.File, dest string) error {
+	out, err := os.Create(dest)
 	if err != nil {
 		return err
 	}
@@ -211,12 +867,14 @@ func extractSevenZipFile(zipFile *sevenzip.File) error {
 }
 
 type Game struct {
-	Name       string  `yaml:"name"`
-	Url        string  `yaml:"url"`
-	Version    string  `yaml:"version"`
-	VersionUrl string  `yaml:"version_url"`
-	PatchUrl   string  `yaml:"patch_url"`
-	Password   *string `yaml:"password"`
+	Name        string  `yaml:"name"`
+	Url         string  `yaml:"url"`
+	Version     string  `yaml:"version"`
+	VersionUrl  string  `yaml:"version_url"`
+	PatchUrl    string  `yaml:"patch_url"`
+	Password    *string `yaml:"password"`
+	Sha256      *string `yaml:"sha256"`
+	PatchSha256 *string `yaml:"patch_sha256"`
 }
 
 type Mod struct {
@@ -225,45 +883,68 @@ type Mod struct {
 	VersionUrl *string `yaml:"version_url"`
 	PatchUrl   string  `yaml:"patch_url"`
 	Password   *string `yaml:"password"`
+	Sha256     *string `yaml:"sha256"`
 }
 
 type Config struct {
-	Game Game  `yaml:"game"`
-	Mods []Mod `yaml:"mods"`
+	Game                Game    `yaml:"game"`
+	Mods                []Mod   `yaml:"mods"`
+	ConcurrentDownloads *int    `yaml:"concurrent_downloads"`
+	SftpPrivateKey      *string `yaml:"sftp_private_key"`
 }
 
-func update() error {
+// concurrentDownloads returns the configured worker pool size, clamped to
+// at least 1 so a misconfigured concurrent_downloads of 0 or less can't
+// turn into a zero-capacity semaphore that every download goroutine
+// blocks on forever.
+func (config Config) concurrentDownloads() int {
+	if config.ConcurrentDownloads != nil {
+		if *config.ConcurrentDownloads < 1 {
+			return 1
+		}
+
+		return *config.ConcurrentDownloads
+	}
+
+	return defaultConcurrentDownloads
+}
+
+func update(sink ProgressSink, logger *slog.Logger) error {
 	var err error
 
 	path, err := os.Executable()
 	if err != nil {
-		return err
+		return fmt.Errorf("locate executable: %w", err)
 	}
 
 	err = os.Chdir(filepath.Dir(path))
 	if err != nil {
-		return err
+		return fmt.Errorf("chdir to executable directory: %w", err)
 	}
 
 	yamlFile, err := os.ReadFile("updater.yaml")
 	if err != nil {
-		return err
+		return fmt.Errorf("read updater.yaml: %w", err)
 	}
 
 	config := Config{}
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
-		return err
+		return fmt.Errorf("parse updater.yaml: %w", err)
+	}
+
+	if config.SftpPrivateKey != nil {
+		sftpPrivateKeyFile = *config.SftpPrivateKey
 	}
 
-	err = download(config.Game.VersionUrl, "_version.txt", false)
+	err = download(config.Game.VersionUrl, "_version.txt", "version", noopSink{}, logger)
 	if err != nil {
-		return err
+		return fmt.Errorf("download game version file: %w", err)
 	}
 
 	remoteVersion, err := readVersion("_version.txt")
 	if err != nil {
-		return err
+		return fmt.Errorf("read remote game version: %w", err)
 	}
 
 	if config.Game.Password == nil && strings.HasSuffix(config.Game.PatchUrl, ".7z") {
@@ -271,14 +952,14 @@ func update() error {
 
 		password, err := readPassword()
 		if err != nil {
-			return err
+			return fmt.Errorf("read base game password: %w", err)
 		}
 
 		config.Game.Password = &password
 	}
 
 	if !fileExists("version") {
-		err = downloadBaseGame(config.Game, remoteVersion)
+		err = downloadBaseGame(config.Game, remoteVersion, sink, logger)
 		if err != nil {
 			return err
 		}
@@ -289,7 +970,7 @@ func update() error {
 	// If a patch was applied all followup patches need to be reapplied on top.
 	forceUpdate := false
 
-	version, err = attemptGameUpdate(config.Game, remoteVersion)
+	version, err = attemptGameUpdate(config.Game, remoteVersion, sink, logger)
 	if err != nil {
 		return err
 	}
@@ -300,50 +981,22 @@ func update() error {
 
 	config.Game.Version = version
 
-	for _, mod := range config.Mods {
-		if mod.Password == nil && strings.HasSuffix(mod.PatchUrl, ".7z") {
-			fmt.Println("Provide password for mod " + mod.Name + ":")
-
-			password, err := readPassword()
-			if err != nil {
-				return err
-			}
-
-			*mod.Password = password
-		}
-
-		if mod.VersionUrl == nil || mod.Version == nil || forceUpdate {
-			err = alwaysUpdate(mod)
-			if err != nil {
-				return err
-			}
-
-			forceUpdate = true
-		} else {
-			version, err = attemptUpdateUsingVersionFile(mod)
-			if err != nil {
-				return err
-			}
-
-			if version != *mod.Version {
-				forceUpdate = true
-			}
-
-			*mod.Version = version
-		}
+	err = updateMods(&config, forceUpdate, sink, logger)
+	if err != nil {
+		return err
 	}
 
 	data, err := yaml.Marshal(config)
 	if err != nil {
-		return err
+		return fmt.Errorf("marshal updater.yaml: %w", err)
 	}
 
 	err = os.WriteFile("updater.yaml", data, 0644)
 	if err != nil {
-		return err
+		return fmt.Errorf("write updater.yaml: %w", err)
 	}
 
-	fmt.Println("Closing in 3 seconds")
+	logger.Info("update complete, closing in 3 seconds")
 	time.Sleep(3 * time.Second)
 
 	return nil
@@ -359,131 +1012,299 @@ func readPassword() (string, error) {
 	return strings.TrimSpace(input), nil
 }
 
-func downloadBaseGame(game Game, remoteVersion string) error {
-	fmt.Println("Downloading base game " + game.Name + "...")
+func downloadBaseGame(game Game, remoteVersion string, sink ProgressSink, logger *slog.Logger) error {
+	logger.Info("downloading base game", "mod", game.Name, "version", remoteVersion)
 
 	if baseVersion(game.Version) != baseVersion(remoteVersion) {
-		return errors.New("The latest version of " + game.Name + " is " + remoteVersion + " while this executable is for " + game.Version + ".")
+		return fmt.Errorf("the latest version of %s is %s while this executable is for %s", game.Name, remoteVersion, game.Version)
 	}
 
-	err := applyPatch(game.Url, game.Password)
+	err := applyPatch(game.Url, game.Password, game.Sha256, game.Name, sink, logger)
 	if err != nil {
-		return err
+		return fmt.Errorf("download base game %s: %w", game.Name, err)
 	}
 
-	fmt.Println()
-	fmt.Println("Done!")
-	fmt.Println()
+	logger.Info("base game downloaded", "mod", game.Name, "version", remoteVersion)
 
 	return nil
 }
 
-func attemptGameUpdate(game Game, remoteVersion string) (string, error) {
+func attemptGameUpdate(game Game, remoteVersion string, sink ProgressSink, logger *slog.Logger) (string, error) {
 	var err error
 
 	currentVersion := game.Version
 
-	fmt.Println("Updating " + game.Name + "...")
+	logger.Info("updating game", "mod", game.Name, "version", currentVersion)
 	if currentVersion != remoteVersion {
-		fmt.Println("Version " + currentVersion + " is outdated")
-		fmt.Println("Latest version is " + remoteVersion)
+		logger.Info("game version outdated", "mod", game.Name, "version", currentVersion, "latest", remoteVersion)
 
 		if baseVersion(currentVersion) != baseVersion(remoteVersion) {
-			return "", errors.New("The latest version of " + game.Name + " needs to be downloaded manually.")
+			return "", fmt.Errorf("the latest version of %s needs to be downloaded manually", game.Name)
 		}
 
-		err = applyPatch(game.PatchUrl, game.Password)
+		err = applyPatch(game.PatchUrl, game.Password, game.PatchSha256, game.Name, sink, logger)
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("update game %s: %w", game.Name, err)
 		}
 
-		fmt.Println()
+		logger.Info("game updated", "mod", game.Name, "version", remoteVersion)
 	} else {
-		fmt.Println("Version " + currentVersion + " is up to date")
-		fmt.Println()
+		logger.Info("game up to date", "mod", game.Name, "version", currentVersion)
 	}
 
 	return remoteVersion, nil
 }
 
-func alwaysUpdate(mod Mod) error {
-	fmt.Println("Downloading latest mod for " + mod.Name + "...")
+// modJob tracks the decision and workspace for a single mod across the
+// download and extract phases of updateMods.
+type modJob struct {
+	index      int
+	mod        *Mod
+	patchFile  string
+	needsPatch bool
+	version    *string
+}
+
+// updateMods resolves which mods need a new patch, downloads the needed
+// patches concurrently (bounded by config.concurrentDownloads), and then
+// extracts them in declared order so that the forceUpdate cascade - where
+// an earlier mod update forces every later mod to be reapplied - is
+// preserved even though the downloads themselves ran in parallel.
+func updateMods(config *Config, forceUpdate bool, sink ProgressSink, logger *slog.Logger) error {
+	jobs := make([]*modJob, len(config.Mods))
+
+	for i := range config.Mods {
+		mod := &config.Mods[i]
+
+		if mod.Password == nil && strings.HasSuffix(mod.PatchUrl, ".7z") {
+			fmt.Println("Provide password for mod " + mod.Name + ":")
+
+			password, err := readPassword()
+			if err != nil {
+				return fmt.Errorf("read password for mod %s: %w", mod.Name, err)
+			}
+
+			mod.Password = &password
+		}
+
+		job := &modJob{index: i, mod: mod, patchFile: cachePath(mod.PatchUrl)}
+
+		if mod.VersionUrl == nil || mod.Version == nil || forceUpdate {
+			job.needsPatch = true
+			forceUpdate = true
+		} else {
+			err := download(*mod.VersionUrl, "_version.txt", "version", noopSink{}, logger)
+			if err != nil {
+				return fmt.Errorf("download version file for mod %s: %w", mod.Name, err)
+			}
+
+			remoteVersion, err := readVersion("_version.txt")
+			if err != nil {
+				return fmt.Errorf("read remote version for mod %s: %w", mod.Name, err)
+			}
+
+			if remoteVersion != *mod.Version {
+				job.needsPatch = true
+				forceUpdate = true
+			}
+
+			job.version = &remoteVersion
+		}
+
+		jobs[i] = job
+	}
 
-	err := applyPatch(mod.PatchUrl, mod.Password)
+	err := downloadModPatches(jobs, config.concurrentDownloads(), sink, logger)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println()
-	fmt.Println("Done!")
-	fmt.Println()
+	for _, job := range jobs {
+		mod := job.mod
+
+		logger.Info("updating mod", "mod", mod.Name)
+
+		if job.needsPatch {
+			if job.version != nil {
+				logger.Info("mod version outdated", "mod", mod.Name, "version", *mod.Version, "latest", *job.version)
+			} else {
+				logger.Info("downloading latest mod", "mod", mod.Name)
+			}
+
+			err = extractPatch(job.patchFile, mod.Password, mod.Name, sink, logger)
+			if err != nil {
+				return fmt.Errorf("update mod %s: %w", mod.Name, err)
+			}
+
+			logger.Info("mod updated", "mod", mod.Name)
+		} else {
+			logger.Info("mod up to date", "mod", mod.Name, "version", *mod.Version)
+		}
+
+		if job.version != nil {
+			mod.Version = job.version
+		}
+	}
 
 	return nil
 }
 
-func attemptUpdateUsingVersionFile(mod Mod) (string, error) {
-	var err error
+// downloadModPatches downloads the patch archive for every job that needs
+// one, running up to concurrency downloads at a time via a buffered channel
+// acting as a semaphore.
+func downloadModPatches(jobs []*modJob, concurrency int, sink ProgressSink, logger *slog.Logger) error {
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+
+	for _, job := range jobs {
+		if !job.needsPatch {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(job *modJob) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			path, err := downloadCached(job.mod.PatchUrl, job.mod.Sha256, job.mod.Name, sink, logger)
+			job.patchFile = path
+
+			if err != nil {
+				err = fmt.Errorf("download patch for mod %s: %w", job.mod.Name, err)
+			}
+
+			errs[job.index] = err
+		}(job)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func patchSuffix(url string) string {
+	if strings.HasSuffix(url, ".7z") {
+		return ".7z"
+	}
+
+	return ".zip"
+}
+
+// cacheDir holds downloaded archives keyed by a hash of their URL, so a
+// re-run of the updater (or another install pointed at the same patches)
+// never has to download an archive it already has.
+const cacheDir = "_cache"
+
+// cacheLocks serializes concurrent downloadCached calls for the same cache
+// path (e.g. two mods sharing a PatchUrl), so one download populates the
+// cache while the rest wait instead of racing to write the same file.
+var cacheLocks sync.Map
+
+func lockCachePath(path string) func() {
+	value, _ := cacheLocks.LoadOrStore(path, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+
+	return mutex.Unlock
+}
+
+// cachePath returns the content-addressable cache location for url, keyed
+// by a SHA-256 hash of the URL itself, similar to Go's module download
+// cache.
+func cachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+patchSuffix(url))
+}
 
-	err = download(*mod.VersionUrl, "_version.txt", false)
+func sha256File(file string) (string, error) {
+	in, err := os.Open(file)
 	if err != nil {
 		return "", err
 	}
+	defer in.Close()
 
-	remoteVersion, err := readVersion("_version.txt")
+	hash := sha256.New()
+	_, err = io.Copy(hash, in)
 	if err != nil {
 		return "", err
 	}
 
-	currentVersion := *mod.Version
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloadCached resolves url to a local archive, reusing a cached copy
+// when one already exists. If expectedSha256 is set, whichever archive is
+// resolved - cached or freshly downloaded - is verified against it; a
+// mismatch is refused rather than silently redownloaded, since it usually
+// means the cache or the archive on the server has been corrupted or
+// tampered with.
+func downloadCached(url string, expectedSha256 *string, name string, sink ProgressSink, logger *slog.Logger) (string, error) {
+	path := cachePath(url)
 
-	fmt.Println("Updating " + mod.Name + "...")
-	if currentVersion != remoteVersion {
-		fmt.Println("Version " + currentVersion + " is outdated")
-		fmt.Println("Downloading version " + remoteVersion)
+	unlock := lockCachePath(path)
+	defer unlock()
 
-		err = applyPatch(mod.PatchUrl, mod.Password)
+	if !fileExists(path) {
+		err := os.MkdirAll(cacheDir, os.ModePerm)
 		if err != nil {
-			return "", err
+			return "", fmt.Errorf("create cache dir %s: %w", cacheDir, err)
 		}
 
-		fmt.Println()
+		err = download(url, path, name, sink, logger)
+		if err != nil {
+			return "", err
+		}
 	} else {
-		fmt.Println("Version " + currentVersion + " is up to date")
-		fmt.Println()
+		logger.Debug("using cached archive", "mod", name, "path", path)
 	}
 
-	return remoteVersion, nil
-}
+	if expectedSha256 != nil {
+		sum, err := sha256File(path)
+		if err != nil {
+			return "", fmt.Errorf("hash cached archive %s: %w", path, err)
+		}
 
-func applyPatch(url string, password *string) error {
-	var name string
-	var err error
+		if sum != *expectedSha256 {
+			return "", fmt.Errorf("%s does not match expected sha256 %s (got %s)", path, *expectedSha256, sum)
+		}
+	}
 
-	if strings.HasSuffix(url, ".7z") {
-		name = "_patch.7z"
-	} else {
-		name = "_patch.zip"
+	return path, nil
+}
+
+func applyPatch(url string, password *string, expectedSha256 *string, name string, sink ProgressSink, logger *slog.Logger) error {
+	path, err := downloadCached(url, expectedSha256, name, sink, logger)
+	if err != nil {
+		return fmt.Errorf("download patch for %s: %w", name, err)
 	}
 
-	err = download(url, name, true)
+	err = extractPatch(path, password, name, sink, logger)
 	if err != nil {
-		return err
+		return fmt.Errorf("extract patch for %s: %w", name, err)
 	}
 
-	fmt.Println("Extracting archive...")
+	return nil
+}
 
-	if strings.HasSuffix(url, ".7z") {
-		err = extractSevenZipArchive(password)
-	} else {
-		err = extractZipArchive()
-	}
+func extractPatch(file string, password *string, name string, sink ProgressSink, logger *slog.Logger) error {
+	logger.Info("extracting archive", "mod", name, "file", file)
 
-	if err != nil {
-		return err
+	if strings.HasSuffix(file, ".7z") {
+		return extractSevenZipArchive(file, password, name, sink, logger)
 	}
 
-	err = os.Remove(name)
-	return err
+	return extractZipArchive(file, name, sink, logger)
 }
 
 func baseVersion(version string) string {
@@ -496,23 +1317,206 @@ func baseVersion(version string) string {
 	return version[:index] + ".0"
 }
 
-func main() {
-	err := update()
+// verifyCache re-hashes every archive in the cache directory that has a
+// recorded sha256 digest in updater.yaml and reports mismatches, analogous
+// to `go mod verify`.
+func verifyCache() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
 
-	if fileExists("_version.txt") {
-		_ = os.Remove("_version.txt")
+	err = os.Chdir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	yamlFile, err := os.ReadFile("updater.yaml")
+	if err != nil {
+		return err
+	}
+
+	config := Config{}
+	err = yaml.Unmarshal(yamlFile, &config)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+
+	verify := func(name string, url string, expectedSha256 *string) error {
+		if expectedSha256 == nil {
+			return nil
+		}
+
+		path := cachePath(url)
+		if !fileExists(path) {
+			return nil
+		}
+
+		sum, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+
+		if sum != *expectedSha256 {
+			mismatches++
+			fmt.Printf("sha256 mismatch for %s (%s): expected %s, got %s\n", path, name, *expectedSha256, sum)
+		} else {
+			fmt.Printf("%s (%s): ok\n", path, name)
+		}
+
+		return nil
+	}
+
+	if err = verify(config.Game.Name, config.Game.Url, config.Game.Sha256); err != nil {
+		return err
+	}
+
+	if err = verify(config.Game.Name, config.Game.PatchUrl, config.Game.PatchSha256); err != nil {
+		return err
+	}
+
+	for _, mod := range config.Mods {
+		if err = verify(mod.Name, mod.PatchUrl, mod.Sha256); err != nil {
+			return err
+		}
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d cached archive(s) failed sha256 verification", mismatches)
+	}
+
+	fmt.Println("All cached archives verified.")
+
+	return nil
+}
+
+// rollback restores the install to the state it was in before the most
+// recent patch application: it undoes every file that application's
+// stagingArea.commit backed up, removes every file that commit newly
+// introduced (per its .created manifest), then removes the backup so it
+// can't be replayed a second time.
+func rollback() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chdir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no backups found in %s", backupDir)
+		}
+
+		return err
+	}
+
+	var latest string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() > latest {
+			latest = entry.Name()
+		}
+	}
+
+	if latest == "" {
+		return fmt.Errorf("no backups found in %s", backupDir)
+	}
+
+	backup := filepath.Join(backupDir, latest)
+
+	err = filepath.Walk(backup, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(backup, path)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(rel), os.ModePerm); err != nil {
+			return err
+		}
+
+		return os.Rename(path, rel)
+	})
+	if err != nil {
+		return fmt.Errorf("restore backup %s: %w", latest, err)
+	}
+
+	manifest := backup + createdManifestSuffix
+	if contents, err := os.ReadFile(manifest); err == nil {
+		for _, name := range strings.Split(string(contents), "\n") {
+			if name == "" {
+				continue
+			}
+
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove created file %s: %w", name, err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("read created-files manifest for backup %s: %w", latest, err)
 	}
 
-	if fileExists("_patch.zip") {
-		_ = os.Remove("_patch.zip")
+	if err := os.RemoveAll(backup); err != nil {
+		return fmt.Errorf("remove backup %s: %w", latest, err)
 	}
 
-	if fileExists("_patch.7z") {
-		_ = os.Remove("_patch.7z")
+	if err := os.Remove(manifest); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove created-files manifest for backup %s: %w", latest, err)
 	}
 
+	fmt.Printf("Rolled back using backup from %s\n", latest)
+
+	return nil
+}
+
+func main() {
+	verifyFlag := flag.Bool("verify", false, "re-hash every cached archive against its recorded sha256 digest")
+	rollbackFlag := flag.Bool("rollback", false, "restore the install to its state before the most recent patch application")
+	progressFlag := flag.String("progress", "terminal", "progress output: terminal, json, or none")
+	logLevelFlag := flag.String("log-level", "info", "log level: debug, info, warn, or error")
+	logJSONFlag := flag.String("log-json", "", "path to also write structured JSON logs to, in addition to stdout")
+	flag.Parse()
+
+	logger, closeLogger, err := newLogger(*logLevelFlag, *logJSONFlag)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		time.Sleep(5 * time.Second)
+		return
+	}
+	defer closeLogger()
+
+	switch {
+	case *rollbackFlag:
+		err = rollback()
+	case *verifyFlag:
+		err = verifyCache()
+	default:
+		var sink ProgressSink
+		sink, err = newProgressSink(*progressFlag)
+		if err == nil {
+			err = update(sink, logger)
+		}
+	}
+
+	if fileExists("_version.txt") {
+		_ = os.Remove("_version.txt")
+	}
+
+	if err != nil {
+		logger.Error("update failed", "error", err)
+		time.Sleep(5 * time.Second)
 	}
 }
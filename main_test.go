@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// chdirTemp creates a temp directory, chdirs into it for the duration of
+// the test, and restores the previous working directory on cleanup.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir %s: %v", dir, err)
+	}
+
+	t.Cleanup(func() {
+		_ = os.Chdir(cwd)
+	})
+
+	return dir
+}
+
+func mustWriteFile(t *testing.T, name string, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		t.Fatalf("create directory for %s: %v", name, err)
+	}
+
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func mustReadFile(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+
+	return string(data)
+}
+
+func TestStagingAreaCommitHappyPath(t *testing.T) {
+	chdirTemp(t)
+
+	mustWriteFile(t, "mods/existing.txt", "old content")
+
+	staging, err := newStagingArea()
+	if err != nil {
+		t.Fatalf("newStagingArea: %v", err)
+	}
+
+	replaced, err := staging.path("mods/existing.txt")
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	mustWriteFile(t, replaced, "new content")
+
+	created, err := staging.path("mods/new.txt")
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	mustWriteFile(t, created, "brand new")
+
+	if err := staging.commit(testLogger()); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if got := mustReadFile(t, "mods/existing.txt"); got != "new content" {
+		t.Errorf("mods/existing.txt = %q, want %q", got, "new content")
+	}
+
+	if got := mustReadFile(t, "mods/new.txt"); got != "brand new" {
+		t.Errorf("mods/new.txt = %q, want %q", got, "brand new")
+	}
+
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Errorf("staging dir %s still exists after commit", stagingDir)
+	}
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		t.Fatalf("read %s: %v", backupDir, err)
+	}
+
+	var backupName string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			backupName = entry.Name()
+		}
+	}
+
+	if backupName == "" {
+		t.Fatalf("expected a backup directory under %s, got %v", backupDir, entries)
+	}
+
+	backup := filepath.Join(backupDir, backupName)
+	if got := mustReadFile(t, filepath.Join(backup, "mods/existing.txt")); got != "old content" {
+		t.Errorf("backed up mods/existing.txt = %q, want %q", got, "old content")
+	}
+
+	manifest := mustReadFile(t, backup+createdManifestSuffix)
+	if manifest != "mods/new.txt" {
+		t.Errorf("created manifest = %q, want %q", manifest, "mods/new.txt")
+	}
+}
+
+// TestStagingAreaCommitRestoresOnReplaceFailure simulates the case the
+// rollback guarantee exists for: a file that already existed is backed up
+// successfully, but the rename that replaces it with the staged version
+// fails partway through commit (e.g. the target is locked). Both that
+// file and every file committed before it must end up exactly as they
+// were before commit ran - none of them should be left missing from both
+// their live location and the backup.
+func TestStagingAreaCommitRestoresOnReplaceFailure(t *testing.T) {
+	chdirTemp(t)
+
+	mustWriteFile(t, "first.txt", "first original")
+	mustWriteFile(t, "second.txt", "second original")
+
+	staging, err := newStagingArea()
+	if err != nil {
+		t.Fatalf("newStagingArea: %v", err)
+	}
+
+	firstStaged, err := staging.path("first.txt")
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	mustWriteFile(t, firstStaged, "first replacement")
+
+	// Record second.txt as changed without actually staging its
+	// replacement content, so the rename that's supposed to move it
+	// into place fails with "no such file" - standing in for a locked
+	// file or any other mid-commit replace failure.
+	staging.files = append(staging.files, "second.txt")
+
+	err = staging.commit(testLogger())
+	if err == nil {
+		t.Fatal("commit: expected an error, got nil")
+	}
+
+	if got := mustReadFile(t, "first.txt"); got != "first original" {
+		t.Errorf("first.txt = %q, want %q (should have been restored)", got, "first original")
+	}
+
+	if got := mustReadFile(t, "second.txt"); got != "second original" {
+		t.Errorf("second.txt = %q, want %q (should have been restored, not destroyed)", got, "second original")
+	}
+
+	if _, err := os.Stat(stagingDir); !os.IsNotExist(err) {
+		t.Errorf("staging dir %s still exists after a failed commit", stagingDir)
+	}
+
+	if entries, err := os.ReadDir(backupDir); err == nil && len(entries) != 0 {
+		t.Errorf("backup dir %s still has entries after a failed commit: %v", backupDir, entries)
+	}
+}